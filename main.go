@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,20 +12,422 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
-const BASE_URL_DAYS = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/diaslibres/oficina/479/ano/2021/mes"
-const BASE_URL_HOURS = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/ajax/x/1613584768/oficina/479/ano/2021/mes"
-const RESERVE_URL = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/index/pk/7539"
+const BASE_URL_DAYS = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/diaslibres/oficina/%d/ano/2021/mes"
+const BASE_URL_HOURS = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/ajax/x/1613584768/oficina/%d/ano/2021/mes"
+const RESERVE_URL = "http://turnos.santafe.gov.ar/turnos/web/frontend.php/turnos/index/pk/%d"
+
+const DEFAULT_OFFICE = 479
+const DEFAULT_PK = 7539
 
 const HISTORY_FILE = "history.json"
+const STORE_FILE = "store.json"
+const OFFICES_FILE = "offices.json"
+const CALENDARS_FILE = "calendars.json"
+const SCRAPES_FILE = "scrapes.json"
+
+const TIMEZONE = "America/Argentina/Buenos_Aires"
+
+const DEFAULT_LANGUAGE = "en"
+
+const DEFAULT_URGENT_MINUTES = 30
+
+const USAGE = "go run main.go ['check', 'test-bot', 'bot', 'forget <day/month> [office]', 'remember <day/month> [office]', 'purge --chat <id>']"
+
+var restrictedCommands = map[string]bool{
+	"forget":   true,
+	"remember": true,
+	"watch":    true,
+	"unwatch":  true,
+}
+
+var monthNames = map[string][]string{
+	"en": {"January", "February", "March", "April", "May", "June", "July", "August", "September", "October", "November", "December"},
+	"es": {"enero", "febrero", "marzo", "abril", "mayo", "junio", "julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre"},
+}
+
+// mutex serializes access to the history, store, calendars and scrapes files
+// between the command handlers and the checks scheduled by the bot. It is
+// never held during network requests.
+var mutex sync.Mutex
+
+var client = &http.Client{Timeout: 30 * time.Second}
+
+var location = loadLocation()
+
+var translations = map[string]map[string]string{
+	"en": {
+		"greeting":         "*Hi there! 👋*\nHere are the new available dates:\n",
+		"date":             "*Date %d/%d:*",
+		"reserve":          "Save the date [here](%s)!",
+		"language_current": "Current language: %s. Use /language en or /language es to change it.",
+		"language_set":     "Language set to English.",
+		"language_invalid": "Unknown language %q. Available languages: en, es.",
+		"unknown_command":  "Unknown command /%s. Use /help to see the available commands.",
+		"start":            "Hi there! 👋 I'll let you know when new dates are available.\n\n",
+		"help":             "Available commands:\n/language [en|es] - show or change the language\n/forget <day/month> [office] - remove a date from history\n/remember <day/month> [office] - add a date to history\n/watch [oficina <office> pk <pk>] - watch another office\n/unwatch oficina <office> pk <pk> - stop watching an office\n/deletemydata - delete the data stored about this chat",
+		"unauthorized":     "You are not allowed to use /%s.",
+		"date_invalid":     "Invalid date %q, expected day/month (e.g. /%s 12/5).",
+		"date_forgotten":   "Date %d/%d removed from history.",
+		"date_unknown":     "Date %d/%d is not in history.",
+		"date_remembered":  "Date %d/%d added to history.",
+		"date_known":       "Date %d/%d is already in history.",
+		"watch_added":      "Now watching office %d (pk %d). It will be included in the next check.",
+		"watch_known":      "Office %d (pk %d) is already being watched.",
+		"watch_invalid":    "Invalid watch %q, expected /watch oficina <office> pk <pk>.",
+		"watch_pick":       "Pick an office to watch, or use /watch oficina <office> pk <pk>:",
+		"watch_none":       "There are no other known offices, use /watch oficina <office> pk <pk>.",
+		"watch_removed":    "Stopped watching office %d (pk %d).",
+		"watch_unknown":    "Office %d (pk %d) is not being watched by this chat.",
+		"watch_default":    "Office %d (pk %d) is the default watch, set up with CHAT_ID, and cannot be removed from the chat.",
+		"watch_button":     "Office %d (pk %d)",
+		"opening":          "*Bookings for %s just opened! 🎉*\nHere are the available dates:\n",
+		"countdown":        "⏳ Bookings for %s usually open on day %d around %s, that is in %d day(s). Stay tuned!",
+		"countdown_today":  "⏳ Bookings for %s usually open today around %s. Stay tuned!",
+		"urgent":           "*🚨 URGENT! 🚨*\nAt the current pace the available slots will be gone in about %d minute(s).\n\n",
+		"data_deleted":     "Deleted the data stored about this chat: its language preference and %d watch(es). Send any command to start again.",
+		"data_configured":  "\n\nThis chat is also set up in the bot configuration (CHAT_ID or URGENT_CHAT_IDS), which only the bot operator can change.",
+	},
+	"es": {
+		"greeting":         "*¡Hola! 👋*\nEstas son las nuevas fechas disponibles:\n",
+		"date":             "*Fecha %d/%d:*",
+		"reserve":          "¡Reservá la fecha [acá](%s)!",
+		"language_current": "Idioma actual: %s. Usá /language en o /language es para cambiarlo.",
+		"language_set":     "Idioma configurado en español.",
+		"language_invalid": "Idioma %q desconocido. Idiomas disponibles: en, es.",
+		"unknown_command":  "Comando /%s desconocido. Usá /help para ver los comandos disponibles.",
+		"start":            "¡Hola! 👋 Te voy a avisar cuando haya nuevas fechas disponibles.\n\n",
+		"help":             "Comandos disponibles:\n/language [en|es] - ver o cambiar el idioma\n/forget <día/mes> [oficina] - quitar una fecha del historial\n/remember <día/mes> [oficina] - agregar una fecha al historial\n/watch [oficina <oficina> pk <pk>] - vigilar otra oficina\n/unwatch oficina <oficina> pk <pk> - dejar de vigilar una oficina\n/deletemydata - borrar los datos guardados de este chat",
+		"unauthorized":     "No tenés permiso para usar /%s.",
+		"date_invalid":     "Fecha %q inválida, se espera día/mes (por ejemplo /%s 12/5).",
+		"date_forgotten":   "Fecha %d/%d eliminada del historial.",
+		"date_unknown":     "La fecha %d/%d no está en el historial.",
+		"date_remembered":  "Fecha %d/%d agregada al historial.",
+		"date_known":       "La fecha %d/%d ya está en el historial.",
+		"watch_added":      "Ahora se vigila la oficina %d (pk %d). Se va a incluir en el próximo chequeo.",
+		"watch_known":      "La oficina %d (pk %d) ya está siendo vigilada.",
+		"watch_invalid":    "Vigilancia %q inválida, se espera /watch oficina <oficina> pk <pk>.",
+		"watch_pick":       "Elegí una oficina para vigilar, o usá /watch oficina <oficina> pk <pk>:",
+		"watch_none":       "No hay otras oficinas conocidas, usá /watch oficina <oficina> pk <pk>.",
+		"watch_removed":    "Se dejó de vigilar la oficina %d (pk %d).",
+		"watch_unknown":    "La oficina %d (pk %d) no está siendo vigilada por este chat.",
+		"watch_default":    "La oficina %d (pk %d) es la vigilancia por defecto, configurada con CHAT_ID, y no se puede quitar desde el chat.",
+		"watch_button":     "Oficina %d (pk %d)",
+		"opening":          "*¡Se abrieron los turnos de %s! 🎉*\nEstas son las fechas disponibles:\n",
+		"countdown":        "⏳ Los turnos de %s suelen abrir el día %d cerca de las %s, o sea en %d día(s). ¡Atentos!",
+		"countdown_today":  "⏳ Los turnos de %s suelen abrir hoy cerca de las %s. ¡Atentos!",
+		"urgent":           "*🚨 ¡URGENTE! 🚨*\nAl ritmo actual los turnos disponibles se van a agotar en unos %d minuto(s).\n\n",
+		"data_deleted":     "Se borraron los datos guardados de este chat: su preferencia de idioma y %d vigilancia(s). Mandá cualquier comando para empezar de nuevo.",
+		"data_configured":  "\n\nEste chat también está en la configuración del bot (CHAT_ID o URGENT_CHAT_IDS), que solo puede cambiar quien opera el bot.",
+	},
+}
 
 type Date struct {
-	Month int `json:"month"`
-	Day   int `json:"day"`
+	Office int `json:"office"`
+	Month  int `json:"month"`
+	Day    int `json:"day"`
+}
+
+type Chat struct {
+	Language string `json:"language"`
+}
+
+type Watch struct {
+	Office int   `json:"office"`
+	Pk     int   `json:"pk"`
+	ChatID int64 `json:"chat_id"`
+}
+
+// Office is an entry of the office list offered by /watch.
+type Office struct {
+	Office int    `json:"office"`
+	Pk     int    `json:"pk"`
+	Name   string `json:"name"`
+}
+
+type Store struct {
+	Chats   map[int64]*Chat `json:"chats"`
+	Watches []Watch         `json:"watches"`
+}
+
+// Calendar is the state of an office calendar as of its last check.
+type Calendar struct {
+	Month      int       `json:"month"`
+	Dates      int       `json:"dates"`
+	RemindedAt time.Time `json:"reminded_at"`
+}
+
+// Opening records when the calendar of a month was first published.
+type Opening struct {
+	Office int       `json:"office"`
+	Month  int       `json:"month"`
+	Time   time.Time `json:"time"`
+}
+
+// Calendars holds the calendar of every office and the openings seen so far.
+// Unlike the store it has no chat data, so it is committed along the history.
+type Calendars struct {
+	Offices  map[int]*Calendar `json:"offices"`
+	Openings []Opening         `json:"openings"`
+}
+
+// Scrape is the number of available slots per day of an office calendar, as
+// of a check. Scrapes are kept out of git since they change on every check.
+type Scrape struct {
+	Month     int         `json:"month"`
+	Slots     map[int]int `json:"slots"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+func loadLocation() *time.Location {
+	loc, err := time.LoadLocation(TIMEZONE)
+	if err != nil {
+		return time.FixedZone("ART", -3*60*60)
+	}
+	return loc
+}
+
+func translate(language string, key string) string {
+	if t, ok := translations[language]; ok {
+		return t[key]
+	}
+	return translations[DEFAULT_LANGUAGE][key]
+}
+
+func detectLanguage(languageCode string) string {
+	if strings.HasPrefix(strings.ToLower(languageCode), "es") {
+		return "es"
+	}
+	return DEFAULT_LANGUAGE
+}
+
+func (store *Store) language(chatId int64) string {
+	if chat, ok := store.Chats[chatId]; ok {
+		return chat.Language
+	}
+	return DEFAULT_LANGUAGE
+}
+
+// allWatches returns the default watch, notified to chatId, followed by the
+// watches added at runtime.
+func (store *Store) allWatches(chatId int64) []Watch {
+	watches := []Watch{{Office: DEFAULT_OFFICE, Pk: DEFAULT_PK, ChatID: chatId}}
+	return append(watches, store.Watches...)
+}
+
+func (store *Store) watching(watch Watch) bool {
+	for _, w := range store.allWatches(adminChat()) {
+		if w == watch {
+			return true
+		}
+	}
+	return false
+}
+
+func (store *Store) addWatch(watch Watch) bool {
+	if store.watching(watch) {
+		return false
+	}
+	store.Watches = append(store.Watches, watch)
+	return true
+}
+
+func (store *Store) removeWatch(watch Watch) bool {
+	for i, w := range store.Watches {
+		if w == watch {
+			store.Watches = append(store.Watches[:i], store.Watches[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// purge removes everything stored about chatId, returning the number of
+// watches removed.
+func (store *Store) purge(chatId int64) int {
+	delete(store.Chats, chatId)
+
+	watches := []Watch{}
+	for _, watch := range store.Watches {
+		if watch.ChatID != chatId {
+			watches = append(watches, watch)
+		}
+	}
+	removed := len(store.Watches) - len(watches)
+	store.Watches = watches
+	return removed
+}
+
+// lastOpening returns the most recent opening recorded for office.
+func (calendars *Calendars) lastOpening(office int) (Opening, bool) {
+	last, found := Opening{}, false
+	for _, opening := range calendars.Openings {
+		if opening.Office == office && (!found || opening.Time.After(last.Time)) {
+			last, found = opening, true
+		}
+	}
+	return last, found
+}
+
+// opened reports whether month already opened at office. Openings older than
+// two months belong to a previous year and are ignored.
+func (calendars *Calendars) opened(office int, month int, now time.Time) bool {
+	for _, opening := range calendars.Openings {
+		if opening.Office == office && opening.Month == month && opening.Time.After(now.AddDate(0, -2, 0)) {
+			return true
+		}
+	}
+	return false
+}
+
+// urgency estimates how many minutes are left until the slots of current run
+// out, from the slots consumed since the previous scrape of the same month.
+// Days published in between do not count as consumption. It reports whether
+// that is within threshold minutes.
+func urgency(previous *Scrape, current *Scrape, threshold int) (int, bool) {
+	if previous == nil || previous.Month != current.Month {
+		return 0, false
+	}
+
+	consumed, remaining := 0, 0
+	for day, slots := range previous.Slots {
+		if taken := slots - current.Slots[day]; taken > 0 {
+			consumed += taken
+		}
+	}
+	for _, slots := range current.Slots {
+		remaining += slots
+	}
+
+	elapsed := current.CheckedAt.Sub(previous.CheckedAt).Minutes()
+	if elapsed <= 0 || consumed == 0 || remaining == 0 {
+		return 0, false
+	}
+
+	minutes := int(float64(remaining) / (float64(consumed) / elapsed))
+	return minutes, minutes <= threshold
+}
+
+func urgentMinutes() int {
+	minutes, err := strconv.Atoi(os.Getenv("URGENT_MINUTES"))
+	if err != nil || minutes <= 0 {
+		return DEFAULT_URGENT_MINUTES
+	}
+	return minutes
+}
+
+func escalationChats() []int64 {
+	chats := []int64{}
+	for _, id := range strings.Split(os.Getenv("URGENT_CHAT_IDS"), ",") {
+		chatId, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			continue
+		}
+		chats = append(chats, chatId)
+	}
+	return chats
+}
+
+func readStore() (*Store, error) {
+	store := &Store{Chats: map[int64]*Chat{}}
+	body, err := ioutil.ReadFile(STORE_FILE)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return store, err
+	}
+
+	err = json.Unmarshal(body, store)
+	if store.Chats == nil {
+		store.Chats = map[int64]*Chat{}
+	}
+	return store, err
+}
+
+func writeStore(store *Store) error {
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(STORE_FILE, data, 0644)
+}
+
+func readCalendars() (*Calendars, error) {
+	calendars := &Calendars{Offices: map[int]*Calendar{}}
+	body, err := ioutil.ReadFile(CALENDARS_FILE)
+	if os.IsNotExist(err) {
+		return calendars, nil
+	}
+	if err != nil {
+		return calendars, err
+	}
+
+	err = json.Unmarshal(body, calendars)
+	if calendars.Offices == nil {
+		calendars.Offices = map[int]*Calendar{}
+	}
+	return calendars, err
+}
+
+func writeCalendars(calendars *Calendars) error {
+	data, err := json.Marshal(calendars)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(CALENDARS_FILE, data, 0644)
+}
+
+func readScrapes() (map[int]*Scrape, error) {
+	scrapes := map[int]*Scrape{}
+	body, err := ioutil.ReadFile(SCRAPES_FILE)
+	if os.IsNotExist(err) {
+		return scrapes, nil
+	}
+	if err != nil {
+		return scrapes, err
+	}
+
+	err = json.Unmarshal(body, &scrapes)
+	return scrapes, err
+}
+
+func writeScrapes(scrapes map[int]*Scrape) error {
+	data, err := json.Marshal(scrapes)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(SCRAPES_FILE, data, 0644)
+}
+
+// readOffices returns the offices listed in OFFICES_FILE, which always
+// include the default one.
+func readOffices() ([]Office, error) {
+	offices := []Office{}
+	body, err := ioutil.ReadFile(OFFICES_FILE)
+	if err != nil && !os.IsNotExist(err) {
+		return offices, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(body, &offices); err != nil {
+			return offices, err
+		}
+	}
+
+	for _, office := range offices {
+		if office.Office == DEFAULT_OFFICE && office.Pk == DEFAULT_PK {
+			return offices, nil
+		}
+	}
+	return append([]Office{{Office: DEFAULT_OFFICE, Pk: DEFAULT_PK}}, offices...), nil
 }
 
 func checkHistory(date Date, history []Date) bool {
@@ -43,6 +447,11 @@ func readHistory() ([]Date, error) {
 	}
 
 	err = json.Unmarshal(body, &history)
+	for i := range history {
+		if history[i].Office == 0 {
+			history[i].Office = DEFAULT_OFFICE
+		}
+	}
 	return history, err
 }
 
@@ -55,8 +464,136 @@ func writeHistory(history []Date) error {
 	return ioutil.WriteFile(HISTORY_FILE, data, 0)
 }
 
+// parseDate parses "day/month [office]", defaulting to DEFAULT_OFFICE.
+func parseDate(s string) (Date, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 1 || len(fields) > 2 {
+		return Date{}, fmt.Errorf("invalid date %q, expected day/month [office]", s)
+	}
+
+	office := DEFAULT_OFFICE
+	if len(fields) == 2 {
+		o, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return Date{}, err
+		}
+		office = o
+	}
+
+	parts := strings.Split(fields[0], "/")
+	if len(parts) != 2 {
+		return Date{}, fmt.Errorf("invalid date %q, expected day/month [office]", s)
+	}
+
+	day, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Date{}, err
+	}
+	month, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Date{}, err
+	}
+
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return Date{}, fmt.Errorf("invalid date %q, expected day/month [office]", s)
+	}
+
+	return Date{Office: office, Month: month, Day: day}, nil
+}
+
+// parseWatch parses "oficina <office> pk <pk>".
+func parseWatch(s string) (Watch, error) {
+	watch := Watch{}
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return watch, fmt.Errorf("invalid watch %q, expected oficina <office> pk <pk>", s)
+	}
+
+	for i := 0; i < len(fields); i += 2 {
+		value, err := strconv.Atoi(fields[i+1])
+		if err != nil {
+			return watch, err
+		}
+
+		switch strings.ToLower(fields[i]) {
+		case "oficina", "office":
+			watch.Office = value
+		case "pk":
+			watch.Pk = value
+		default:
+			return watch, fmt.Errorf("invalid watch %q, unknown key %q", s, fields[i])
+		}
+	}
+
+	if watch.Office <= 0 || watch.Pk <= 0 {
+		return watch, fmt.Errorf("invalid watch %q, expected oficina <office> pk <pk>", s)
+	}
+
+	return watch, nil
+}
+
+// editHistory removes ("forget") or adds ("remember") a date in history,
+// returning whether history was changed.
+func editHistory(action string, date Date) (bool, error) {
+	history, err := readHistory()
+	if err != nil {
+		return false, err
+	}
+
+	found := checkHistory(date, history)
+	switch action {
+	case "forget":
+		if !found {
+			return false, nil
+		}
+		kept := []Date{}
+		for _, historyDate := range history {
+			if historyDate != date {
+				kept = append(kept, historyDate)
+			}
+		}
+		history = kept
+	case "remember":
+		if found {
+			return false, nil
+		}
+		history = append(history, date)
+	default:
+		return false, fmt.Errorf("unknown history action %q", action)
+	}
+
+	return true, writeHistory(history)
+}
+
+// adminChat returns the CHAT_ID chat, or 0 when it is not configured.
+func adminChat() int64 {
+	chatId, err := strconv.ParseInt(os.Getenv("CHAT_ID"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return chatId
+}
+
+// configuredChat reports whether chatId comes from the environment, where it
+// cannot be purged from.
+func configuredChat(chatId int64) bool {
+	if chatId == adminChat() {
+		return true
+	}
+	for _, id := range escalationChats() {
+		if id == chatId {
+			return true
+		}
+	}
+	return false
+}
+
+func authorized(chatId int64) bool {
+	return chatId != 0 && chatId == adminChat()
+}
+
 func get(url string) ([]byte, error) {
-	response, err := http.Get(url)
+	response, err := client.Get(url)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -66,8 +603,8 @@ func get(url string) ([]byte, error) {
 	return bytes, err
 }
 
-func availableDates(month int) ([]Date, error) {
-	url := fmt.Sprintf("%s/%d", BASE_URL_DAYS, month)
+func availableDates(office int, month int) ([]Date, error) {
+	url := fmt.Sprintf(BASE_URL_DAYS+"/%d", office, month)
 	bytes, err := get(url)
 	if err != nil {
 		return []Date{}, err
@@ -84,14 +621,14 @@ func availableDates(month int) ([]Date, error) {
 		if err != nil {
 			return []Date{}, err
 		}
-		dates[i] = Date{Month: month, Day: d}
+		dates[i] = Date{Office: office, Month: month, Day: d}
 	}
 
 	return dates, nil
 }
 
 func availableHours(date Date) ([]string, error) {
-	url := fmt.Sprintf("%s/%d/dia/%d", BASE_URL_HOURS, date.Month, date.Day)
+	url := fmt.Sprintf(BASE_URL_HOURS+"/%d/dia/%d", date.Office, date.Month, date.Day)
 	bytes, err := get(url)
 	if err != nil {
 		return []string{}, err
@@ -110,14 +647,22 @@ func availableHours(date Date) ([]string, error) {
 	return clean, nil
 }
 
-func formatMessage(m map[Date][]string) string {
-	msg := "*Hi there! 👋*\nHere are the new available dates:\n"
+func monthName(language string, month int) string {
+	names, ok := monthNames[language]
+	if !ok {
+		names = monthNames[DEFAULT_LANGUAGE]
+	}
+	return names[month-1]
+}
+
+func formatMessage(header string, m map[Date][]string, pk int, language string) string {
+	msg := header
 	for date, times := range m {
-		msg = fmt.Sprintf("%s\n*Date %d/%d:*", msg, date.Day, date.Month)
+		msg = fmt.Sprintf("%s\n"+translate(language, "date"), msg, date.Day, date.Month)
 		msg = fmt.Sprintf("%s\n%s\n", msg, strings.Join(times, "\n"))
 	}
 
-	msg = fmt.Sprintf("%s\nSave the date [here](%s)!", msg, RESERVE_URL)
+	msg = fmt.Sprintf("%s\n"+translate(language, "reserve"), msg, fmt.Sprintf(RESERVE_URL, pk))
 	return msg
 }
 
@@ -129,55 +674,304 @@ func handleCheck(chatId int64, bot *tgbotapi.BotAPI) error {
 		nextMonth = 1
 	}
 
+	mutex.Lock()
 	history, err := readHistory()
+	if err != nil {
+		mutex.Unlock()
+		return err
+	}
+	store, err := readStore()
+	if err != nil {
+		mutex.Unlock()
+		return err
+	}
+	calendars, err := readCalendars()
+	if err != nil {
+		mutex.Unlock()
+		return err
+	}
+	scrapes, err := readScrapes()
+	mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	before, err := json.Marshal(calendars)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Checking for month: %d", nextMonth)
-	dates, err := availableDates(nextMonth)
+	watches := store.allWatches(chatId)
+	offices := []int{}
+	for _, watch := range watches {
+		known := false
+		for _, office := range offices {
+			known = known || office == watch.Office
+		}
+		if !known {
+			offices = append(offices, watch.Office)
+		}
+	}
+
+	newDates := []Date{}
+	for _, office := range offices {
+		dates, err := checkOffice(office, nextMonth, watches, history, store, calendars, scrapes, bot)
+		if err != nil {
+			log.Printf("Check for office %d failed: %v", office, err)
+			continue
+		}
+		newDates = append(newDates, dates...)
+	}
+
+	mutex.Lock()
+	err = writeScrapes(scrapes)
+	mutex.Unlock()
 	if err != nil {
 		return err
 	}
-	log.Printf("Possible dates for %d: %v", nextMonth, dates)
-	possibleTimes := make(map[Date][]string)
+
+	// Only checks write the calendars, and only when they changed, so that
+	// quiet checks do not produce a commit.
+	after, err := json.Marshal(calendars)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(before, after) {
+		log.Println("Updating calendars")
+		mutex.Lock()
+		err = writeCalendars(calendars)
+		mutex.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(newDates) == 0 {
+		return nil
+	}
+
+	log.Println("Updating history with new dates")
+	if err = recordHistory(newDates); err != nil {
+		return err
+	}
+	log.Println("History saved!")
+
+	return nil
+}
+
+// recordHistory adds dates to history. The file is read again since it may
+// have been edited by a command while the check was running.
+func recordHistory(dates []Date) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	history, err := readHistory()
+	if err != nil {
+		return err
+	}
+
 	for _, date := range dates {
-		if checkHistory(date, history) {
-			continue
+		if !checkHistory(date, history) {
+			history = append(history, date)
 		}
+	}
+	return writeHistory(history)
+}
 
-		history = append(history, date)
+// checkOffice checks the month calendar of office and notifies its watchers,
+// returning the new dates that were notified.
+func checkOffice(office int, nextMonth int, watches []Watch, history []Date, store *Store, calendars *Calendars, scrapes map[int]*Scrape, bot *tgbotapi.BotAPI) ([]Date, error) {
+	log.Printf("Checking office %d for month: %d", office, nextMonth)
+	dates, err := availableDates(office, nextMonth)
+	if err != nil {
+		return []Date{}, err
+	}
+	log.Printf("Possible dates for %d: %v", nextMonth, dates)
+	now := time.Now()
+	newDates := []Date{}
+	possibleTimes := make(map[Date][]string)
+	scrape := &Scrape{Month: nextMonth, Slots: map[int]int{}, CheckedAt: now}
+	complete := true
+	for _, date := range dates {
+		known := checkHistory(date, history)
 		log.Printf("Checking date: %v", date)
 		times, err := availableHours(date)
+		if err != nil && known {
+			log.Printf("Skipping hours of %v: %v", date, err)
+			complete = false
+			continue
+		}
 		if err != nil {
-			return err
+			return []Date{}, err
 		}
 		log.Printf("Available hours: %v", times)
+		scrape.Slots[date.Day] = len(times)
+
+		if known {
+			continue
+		}
+
+		newDates = append(newDates, date)
 		possibleTimes[date] = times
 	}
 
-	if len(possibleTimes) == 0 {
-		log.Println("Nothing to notify")
+	// A partial scrape would look like consumption, so the previous one is
+	// kept and urgency is not estimated.
+	minutes, urgent := 0, false
+	if complete {
+		minutes, urgent = urgency(scrapes[office], scrape, urgentMinutes())
+		scrapes[office] = scrape
+	}
+
+	calendar, ok := calendars.Offices[office]
+	if !ok {
+		calendar = &Calendar{}
+		calendars.Offices[office] = calendar
+	}
+	opened := ok && calendar.Month == nextMonth && calendar.Dates == 0 && len(dates) > 0 &&
+		!calendars.opened(office, nextMonth, now)
+
+	if len(dates) == 0 {
+		if err = handleCountdown(office, nextMonth, watches, store, calendars, bot); err != nil {
+			return []Date{}, err
+		}
+	}
+
+	if len(possibleTimes) > 0 {
+		if urgent {
+			log.Printf("Slots at office %d will be gone in about %d minute(s)", office, minutes)
+		}
+
+		err = notifyOffice(office, watches, store, bot, urgent, func(watch Watch, language string) string {
+			header := translate(language, "greeting")
+			if opened {
+				header = fmt.Sprintf(translate(language, "opening"), monthName(language, nextMonth))
+			}
+			if urgent {
+				header = fmt.Sprintf(translate(language, "urgent"), minutes) + header
+			}
+			return formatMessage(header, possibleTimes, watch.Pk, language)
+		})
+		if err != nil {
+			return []Date{}, err
+		}
+	} else {
+		log.Printf("Nothing to notify for office %d", office)
+	}
+
+	calendar.Month, calendar.Dates = nextMonth, len(dates)
+	if opened {
+		log.Printf("Bookings for month %d just opened at office %d", nextMonth, office)
+		calendars.Openings = append(calendars.Openings, Opening{Office: office, Month: nextMonth, Time: now})
+	}
+
+	return newDates, nil
+}
+
+// notifyOffice sends a message to every watcher of office. Messages are silent
+// when SILENT is set, unless they are urgent, in which case they are also sent
+// to the URGENT_CHAT_IDS escalation chats. It only fails when no message could
+// be sent, so that a single broken chat does not cause duplicate
+// notifications to the others.
+func notifyOffice(office int, watches []Watch, store *Store, bot *tgbotapi.BotAPI, urgent bool, format func(Watch, string) string) error {
+	recipients := []Watch{}
+	notified := map[int64]bool{}
+	for _, watch := range watches {
+		if watch.Office == office {
+			recipients = append(recipients, watch)
+			notified[watch.ChatID] = true
+		}
+	}
+
+	if urgent && len(recipients) > 0 {
+		for _, chatId := range escalationChats() {
+			if !notified[chatId] {
+				recipients = append(recipients, Watch{Office: office, Pk: recipients[0].Pk, ChatID: chatId})
+				notified[chatId] = true
+			}
+		}
+	}
+
+	var err error
+	sent := 0
+	for _, watch := range recipients {
+		msg := tgbotapi.NewMessage(watch.ChatID, format(watch, store.language(watch.ChatID)))
+		msg.ParseMode = "Markdown"
+		msg.DisableNotification = os.Getenv("SILENT") != "" && !urgent
+
+		log.Printf("Sending message to %d ...", watch.ChatID)
+		if _, err = bot.Send(msg); err != nil {
+			log.Printf("Message to %d failed: %v", watch.ChatID, err)
+			continue
+		}
+		sent++
+		log.Println("Message sent!")
+	}
+
+	if sent == 0 && len(recipients) > 0 {
+		return err
+	}
+	return nil
+}
+
+// handleCountdown reminds the watchers of office, at most once a day, when the
+// calendar of month is expected to open within COUNTDOWN_DAYS days. The
+// expected opening is the day and time of the last recorded opening.
+func handleCountdown(office int, month int, watches []Watch, store *Store, calendars *Calendars, bot *tgbotapi.BotAPI) error {
+	days, err := strconv.Atoi(os.Getenv("COUNTDOWN_DAYS"))
+	if err != nil || days <= 0 {
+		return nil
+	}
+
+	last, ok := calendars.lastOpening(office)
+	if !ok || last.Month == month {
+		return nil
+	}
+
+	now := time.Now().In(location)
+	calendar := calendars.Offices[office]
+	remindedAt := calendar.RemindedAt.In(location)
+	if remindedAt.YearDay() == now.YearDay() && remindedAt.Year() == now.Year() {
 		return nil
 	}
 
-	msg := tgbotapi.NewMessage(chatId, formatMessage(possibleTimes))
-	msg.ParseMode = "Markdown"
+	openingTime := last.Time.In(location)
+	lastDay := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, location).Day()
+	day := openingTime.Day()
+	if day > lastDay {
+		day = lastDay
+	}
+
+	expected := time.Date(now.Year(), now.Month(), day, openingTime.Hour(), openingTime.Minute(), 0, 0, location)
+	if expected.Before(now) || expected.Sub(now) > time.Duration(days)*24*time.Hour {
+		return nil
+	}
 
-	log.Println("Sending message ...")
-	_, err = bot.Send(msg)
+	remaining := expected.Day() - now.Day()
+	clock := expected.Format("15:04")
+	log.Printf("Bookings for month %d at office %d expected to open on %v", month, office, expected)
+	err = notifyOffice(office, watches, store, bot, false, func(watch Watch, language string) string {
+		if remaining == 0 {
+			return fmt.Sprintf(translate(language, "countdown_today"), monthName(language, month), clock)
+		}
+		return fmt.Sprintf(translate(language, "countdown"), monthName(language, month), expected.Day(), clock, remaining)
+	})
 	if err != nil {
 		return err
 	}
-	log.Println("Message sent!")
-
-	log.Println("Updating history with new dates")
-	writeHistory(history)
-	log.Println("History saved!")
 
+	calendar.RemindedAt = now
 	return nil
 }
 
+func scheduleChecks(chatId int64, interval time.Duration, bot *tgbotapi.BotAPI) {
+	log.Printf("Scheduling checks every %s", interval)
+	for range time.Tick(interval) {
+		if err := handleCheck(chatId, bot); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
 func handleTestBot(bot *tgbotapi.BotAPI) error {
 	log.Printf("Authorized on account %s", bot.Self.UserName)
 
@@ -202,9 +996,295 @@ func handleTestBot(bot *tgbotapi.BotAPI) error {
 	return nil
 }
 
+func handleLanguage(chatId int64, args string, store *Store) string {
+	chat := store.Chats[chatId]
+	language := strings.ToLower(strings.TrimSpace(args))
+	if language == "" {
+		return fmt.Sprintf(translate(chat.Language, "language_current"), chat.Language)
+	}
+
+	if _, ok := translations[language]; !ok {
+		return fmt.Sprintf(translate(chat.Language, "language_invalid"), language)
+	}
+
+	chat.Language = language
+	return translate(chat.Language, "language_set")
+}
+
+func handleEditHistory(action string, args string, language string) (string, error) {
+	date, err := parseDate(args)
+	if err != nil {
+		return fmt.Sprintf(translate(language, "date_invalid"), args, action), nil
+	}
+
+	changed, err := editHistory(action, date)
+	if err != nil {
+		return "", err
+	}
+
+	key := map[string]map[bool]string{
+		"forget":   {true: "date_forgotten", false: "date_unknown"},
+		"remember": {true: "date_remembered", false: "date_known"},
+	}[action][changed]
+	return fmt.Sprintf(translate(language, key), date.Day, date.Month), nil
+}
+
+func handleWatch(chatId int64, args string, store *Store) string {
+	language := store.language(chatId)
+	watch, err := parseWatch(args)
+	if err != nil {
+		return fmt.Sprintf(translate(language, "watch_invalid"), args)
+	}
+
+	watch.ChatID = chatId
+	if !store.addWatch(watch) {
+		return fmt.Sprintf(translate(language, "watch_known"), watch.Office, watch.Pk)
+	}
+
+	log.Printf("New watch: %v", watch)
+	return fmt.Sprintf(translate(language, "watch_added"), watch.Office, watch.Pk)
+}
+
+func handleUnwatch(chatId int64, args string, store *Store) string {
+	language := store.language(chatId)
+	watch, err := parseWatch(args)
+	if err != nil {
+		return fmt.Sprintf(translate(language, "watch_invalid"), args)
+	}
+
+	watch.ChatID = chatId
+	if watch == store.allWatches(adminChat())[0] {
+		return fmt.Sprintf(translate(language, "watch_default"), watch.Office, watch.Pk)
+	}
+	if !store.removeWatch(watch) {
+		return fmt.Sprintf(translate(language, "watch_unknown"), watch.Office, watch.Pk)
+	}
+
+	log.Printf("Removed watch: %v", watch)
+	return fmt.Sprintf(translate(language, "watch_removed"), watch.Office, watch.Pk)
+}
+
+// watchKeyboard lists the offices of OFFICES_FILE that chatId is not watching
+// yet, so they can be picked with a single tap.
+func watchKeyboard(chatId int64, store *Store, offices []Office, language string) (tgbotapi.InlineKeyboardMarkup, bool) {
+	rows := [][]tgbotapi.InlineKeyboardButton{}
+	for _, office := range offices {
+		if store.watching(Watch{Office: office.Office, Pk: office.Pk, ChatID: chatId}) {
+			continue
+		}
+
+		text := fmt.Sprintf(translate(language, "watch_button"), office.Office, office.Pk)
+		if office.Name != "" {
+			text = fmt.Sprintf("%s - %s", office.Name, text)
+		}
+		data := fmt.Sprintf("watch oficina %d pk %d", office.Office, office.Pk)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, data)))
+	}
+
+	return tgbotapi.NewInlineKeyboardMarkup(rows...), len(rows) > 0
+}
+
+func handleCommand(message *tgbotapi.Message) (tgbotapi.MessageConfig, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	chatId := message.Chat.ID
+	reply := tgbotapi.NewMessage(chatId, "")
+
+	store, err := readStore()
+	if err != nil {
+		return reply, err
+	}
+
+	if _, ok := store.Chats[chatId]; !ok {
+		language := DEFAULT_LANGUAGE
+		if message.From != nil {
+			language = detectLanguage(message.From.LanguageCode)
+		}
+		log.Printf("New chat %d, detected language: %s", chatId, language)
+		store.Chats[chatId] = &Chat{Language: language}
+	}
+
+	command := message.Command()
+	args := message.CommandArguments()
+	language := store.language(chatId)
+	if command == "deletemydata" {
+		removed := store.purge(chatId)
+		log.Printf("Purged chat %d and %d watch(es)", chatId, removed)
+		reply.Text = fmt.Sprintf(translate(language, "data_deleted"), removed)
+		if configuredChat(chatId) {
+			reply.Text += translate(language, "data_configured")
+		}
+		return reply, writeStore(store)
+	}
+
+	if restrictedCommands[command] && !authorized(chatId) {
+		reply.Text = fmt.Sprintf(translate(language, "unauthorized"), command)
+		return reply, writeStore(store)
+	}
+
+	switch command {
+	case "start":
+		reply.Text = translate(language, "start") + translate(language, "help")
+	case "help":
+		reply.Text = translate(language, "help")
+	case "language":
+		reply.Text = handleLanguage(chatId, args, store)
+	case "forget", "remember":
+		reply.Text, err = handleEditHistory(command, args, language)
+		if err != nil {
+			return reply, err
+		}
+	case "watch":
+		if strings.TrimSpace(args) == "" {
+			offices, err := readOffices()
+			if err != nil {
+				return reply, err
+			}
+
+			keyboard, ok := watchKeyboard(chatId, store, offices, language)
+			if !ok {
+				reply.Text = translate(language, "watch_none")
+				break
+			}
+			reply.Text = translate(language, "watch_pick")
+			reply.ReplyMarkup = keyboard
+			break
+		}
+		reply.Text = handleWatch(chatId, args, store)
+	case "unwatch":
+		reply.Text = handleUnwatch(chatId, args, store)
+	default:
+		reply.Text = fmt.Sprintf(translate(language, "unknown_command"), command)
+	}
+
+	return reply, writeStore(store)
+}
+
+func handleCallback(query *tgbotapi.CallbackQuery) (tgbotapi.MessageConfig, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	chatId := query.Message.Chat.ID
+	reply := tgbotapi.NewMessage(chatId, "")
+
+	store, err := readStore()
+	if err != nil {
+		return reply, err
+	}
+
+	language := store.language(chatId)
+	if !strings.HasPrefix(query.Data, "watch ") {
+		return reply, fmt.Errorf("unknown callback %q", query.Data)
+	}
+	if !authorized(chatId) {
+		reply.Text = fmt.Sprintf(translate(language, "unauthorized"), "watch")
+		return reply, nil
+	}
+
+	reply.Text = handleWatch(chatId, strings.TrimPrefix(query.Data, "watch "), store)
+	return reply, writeStore(store)
+}
+
+// addressedToOtherBot reports whether message is a "/command@bot" meant for a
+// bot other than username, as happens in group chats.
+func addressedToOtherBot(message *tgbotapi.Message, username string) bool {
+	parts := strings.SplitN(message.CommandWithAt(), "@", 2)
+	return len(parts) == 2 && !strings.EqualFold(parts[1], username)
+}
+
+func handleBot(bot *tgbotapi.BotAPI) error {
+	log.Printf("Authorized on account %s", bot.Self.UserName)
+
+	u := tgbotapi.NewUpdate(0)
+	u.Timeout = 60
+
+	updates, err := bot.GetUpdatesChan(u)
+	if err != nil {
+		return err
+	}
+
+	for update := range updates {
+		if update.CallbackQuery != nil && update.CallbackQuery.Message != nil {
+			log.Printf("[%d] Callback: %s", update.CallbackQuery.Message.Chat.ID, update.CallbackQuery.Data)
+			bot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
+
+			reply, err := handleCallback(update.CallbackQuery)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			bot.Send(reply)
+			continue
+		}
+
+		if update.Message == nil || !update.Message.IsCommand() {
+			continue
+		}
+		if addressedToOtherBot(update.Message, bot.Self.UserName) {
+			continue
+		}
+		log.Printf("[%d] Command: %s", update.Message.Chat.ID, update.Message.Text)
+
+		reply, err := handleCommand(update.Message)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		bot.Send(reply)
+	}
+
+	return nil
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		log.Fatal(USAGE)
+	}
+
+	switch os.Args[1] {
+	case "forget", "remember":
+		if len(os.Args) < 3 || len(os.Args) > 4 {
+			log.Fatal(USAGE)
+		}
+
+		date, err := parseDate(strings.Join(os.Args[2:], " "))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		changed, err := editHistory(os.Args[1], date)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("History updated: %t", changed)
+		return
+	case "purge":
+		flags := flag.NewFlagSet("purge", flag.ExitOnError)
+		chatId := flags.Int64("chat", 0, "chat ID whose data will be deleted")
+		flags.Parse(os.Args[2:])
+		if *chatId == 0 {
+			log.Fatal(USAGE)
+		}
+
+		store, err := readStore()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		removed := store.purge(*chatId)
+		if err = writeStore(store); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Purged chat %d and %d watch(es)", *chatId, removed)
+		if configuredChat(*chatId) {
+			log.Printf("Chat %d is still set in CHAT_ID or URGENT_CHAT_IDS", *chatId)
+		}
+		return
+	}
+
 	if len(os.Args) != 2 {
-		log.Fatal("go run main.go ['check', 'test-bot']")
+		log.Fatal(USAGE)
 	}
 
 	bot, err := tgbotapi.NewBotAPI(os.Getenv("BOT_TOKEN"))
@@ -226,7 +1306,24 @@ func main() {
 		if err = handleTestBot(bot); err != nil {
 			log.Fatal(err)
 		}
+	case "bot":
+		if interval := os.Getenv("CHECK_INTERVAL"); interval != "" {
+			chatId, err := strconv.ParseInt(os.Getenv("CHAT_ID"), 10, 64)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			d, err := time.ParseDuration(interval)
+			if err != nil {
+				log.Fatal(err)
+			}
+			go scheduleChecks(chatId, d, bot)
+		}
+
+		if err = handleBot(bot); err != nil {
+			log.Fatal(err)
+		}
 	default:
-		log.Fatal("go run main.go ['check', 'test-bot']")
+		log.Fatal(USAGE)
 	}
 }
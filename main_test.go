@@ -0,0 +1,171 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Date
+		err   bool
+	}{
+		{input: "12/5", want: Date{Office: DEFAULT_OFFICE, Month: 5, Day: 12}},
+		{input: " 1/12 ", want: Date{Office: DEFAULT_OFFICE, Month: 12, Day: 1}},
+		{input: "31/1", want: Date{Office: DEFAULT_OFFICE, Month: 1, Day: 31}},
+		{input: "12/5 512", want: Date{Office: 512, Month: 5, Day: 12}},
+		{input: "", err: true},
+		{input: "12/5 abc", err: true},
+		{input: "12/5 512 1", err: true},
+		{input: "12", err: true},
+		{input: "12/5/2021", err: true},
+		{input: "a/5", err: true},
+		{input: "12/b", err: true},
+		{input: "0/5", err: true},
+		{input: "32/5", err: true},
+		{input: "12/0", err: true},
+		{input: "12/13", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseDate(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseDate(%q) = %v, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDate(%q) returned error: %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseDate(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseWatch(t *testing.T) {
+	tests := []struct {
+		input string
+		want  Watch
+		err   bool
+	}{
+		{input: "oficina 512 pk 7600", want: Watch{Office: 512, Pk: 7600}},
+		{input: "pk 7600 oficina 512", want: Watch{Office: 512, Pk: 7600}},
+		{input: "OFFICE 512 PK 7600", want: Watch{Office: 512, Pk: 7600}},
+		{input: "", err: true},
+		{input: "oficina 512", err: true},
+		{input: "oficina 512 pk", err: true},
+		{input: "oficina 512 pk 7600 extra", err: true},
+		{input: "oficina abc pk 7600", err: true},
+		{input: "oficina 512 dia 7600", err: true},
+		{input: "oficina 512 oficina 513", err: true},
+		{input: "oficina 0 pk 7600", err: true},
+		{input: "oficina 512 pk -1", err: true},
+	}
+
+	for _, test := range tests {
+		got, err := parseWatch(test.input)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseWatch(%q) = %v, want error", test.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseWatch(%q) returned error: %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseWatch(%q) = %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestUrgency(t *testing.T) {
+	start := time.Date(2021, 3, 1, 10, 0, 0, 0, time.UTC)
+	scrape := func(minutes int, month int, slots map[int]int) *Scrape {
+		return &Scrape{Month: month, Slots: slots, CheckedAt: start.Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	tests := []struct {
+		name     string
+		previous *Scrape
+		current  *Scrape
+		minutes  int
+		urgent   bool
+	}{
+		{
+			name:    "no previous scrape",
+			current: scrape(15, 4, map[int]int{1: 10}),
+		},
+		{
+			name:     "previous scrape of another month",
+			previous: scrape(0, 3, map[int]int{1: 70}),
+			current:  scrape(15, 4, map[int]int{1: 10}),
+		},
+		{
+			name:     "nothing consumed",
+			previous: scrape(0, 4, map[int]int{1: 10, 2: 10}),
+			current:  scrape(15, 4, map[int]int{1: 10, 2: 10}),
+		},
+		{
+			name:     "fast consumption",
+			previous: scrape(0, 4, map[int]int{1: 40, 2: 40}),
+			current:  scrape(15, 4, map[int]int{1: 10, 2: 10}),
+			minutes:  5,
+			urgent:   true,
+		},
+		{
+			name:     "slow consumption",
+			previous: scrape(0, 4, map[int]int{1: 40, 2: 40}),
+			current:  scrape(15, 4, map[int]int{1: 39, 2: 40}),
+			minutes:  1185,
+		},
+		{
+			name:     "rate is measured between consecutive scrapes",
+			previous: scrape(3*24*60, 4, map[int]int{1: 70}),
+			current:  scrape(3*24*60+15, 4, map[int]int{1: 10}),
+			minutes:  2,
+			urgent:   true,
+		},
+		{
+			name:     "newly published days are not consumption",
+			previous: scrape(0, 4, map[int]int{1: 10}),
+			current:  scrape(15, 4, map[int]int{1: 10, 2: 40}),
+		},
+		{
+			name:     "newly published days do not hide consumption",
+			previous: scrape(0, 4, map[int]int{1: 40}),
+			current:  scrape(15, 4, map[int]int{1: 10, 2: 40}),
+			minutes:  25,
+			urgent:   true,
+		},
+		{
+			name:     "sold out days are consumption",
+			previous: scrape(0, 4, map[int]int{1: 30, 2: 10}),
+			current:  scrape(15, 4, map[int]int{2: 10}),
+			minutes:  5,
+			urgent:   true,
+		},
+		{
+			name:     "everything is gone",
+			previous: scrape(0, 4, map[int]int{1: 30}),
+			current:  scrape(15, 4, map[int]int{}),
+		},
+		{
+			name:     "no time elapsed",
+			previous: scrape(15, 4, map[int]int{1: 30}),
+			current:  scrape(15, 4, map[int]int{1: 10}),
+		},
+	}
+
+	for _, test := range tests {
+		minutes, urgent := urgency(test.previous, test.current, 30)
+		if minutes != test.minutes || urgent != test.urgent {
+			t.Errorf("%s: urgency() = (%d, %t), want (%d, %t)", test.name, minutes, urgent, test.minutes, test.urgent)
+		}
+	}
+}